@@ -0,0 +1,163 @@
+package types
+
+import "sync"
+
+// ChangeMask is a bitfield over the fields of RawState, describing which of
+// them were touched by a single write.
+type ChangeMask uint32
+
+// Bits of ChangeMask, one per field of RawState that subscribers may care
+// about. NextAction is transient handler-loop bookkeeping and has no bit: a
+// write that only changes NextAction produces no Change. LastKey, which
+// renderers may still want to observe, has its own bit.
+const (
+	ChangeCode ChangeMask = 1 << iota
+	ChangeDot
+	ChangeMode
+	ChangePending
+	ChangeNotes
+	ChangeLastKey
+)
+
+// Change describes a coalesced state change, delivered to a subscriber after
+// the write lock protecting the State has been released.
+type Change struct {
+	// Mask records which fields changed relative to the state before the
+	// write that produced this Change.
+	Mask ChangeMask
+	// Raw is the state right after the write.
+	Raw RawState
+	// Version is the State.Version() of the write that produced this
+	// Change, used to tell which of two Changes that reach notify out of
+	// publish order, because two writers published concurrently, is
+	// actually newer.
+	Version uint64
+}
+
+// CancelFunc unsubscribes a channel previously returned by State.Subscribe.
+// It is idempotent: calling it more than once has no additional effect.
+type CancelFunc func()
+
+// subscriber is a single registration created by Subscribe.
+type subscriber struct {
+	mask ChangeMask
+	ch   chan Change
+}
+
+// Subscribe registers for notifications about changes to the fields named
+// in mask, and returns a channel on which they are delivered along with a
+// CancelFunc to unregister.
+//
+// The channel is buffered and only ever holds the latest undelivered
+// Change: if a subscriber has not drained its channel by the time the next
+// matching change happens, the stale Change is dropped in favor of the new
+// one. This mirrors how PopForRedraw already collapses bursts of pending
+// notes, and guarantees that a slow or stuck subscriber can never block the
+// editor hot path.
+func (s *State) Subscribe(mask ChangeMask) (<-chan Change, CancelFunc) {
+	sub := &subscriber{mask: mask, ch: make(chan Change, 1)}
+	s.subMutex.Lock()
+	s.subs = append(s.subs, sub)
+	s.subMutex.Unlock()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			s.subMutex.Lock()
+			defer s.subMutex.Unlock()
+			for i, other := range s.subs {
+				if other == sub {
+					s.subs = append(s.subs[:i], s.subs[i+1:]...)
+					break
+				}
+			}
+			close(sub.ch)
+		})
+	}
+	return sub.ch, cancel
+}
+
+// notify fans out a coalesced Change to every subscriber whose mask
+// intersects changed. It must be called without s.writeMu held, since
+// subscribers may call back into s from their goroutine.
+//
+// Two concurrent writers publish under writeMu in a well-defined order, but
+// release the lock and call notify independently, so their notify calls can
+// reach a given subscriber in either order. version, read from the word
+// while writeMu was still held, lets notify tell which of two racing
+// Changes is actually newer, instead of trusting the order notify itself
+// was called in.
+func (s *State) notify(changed ChangeMask, raw RawState, version uint64) {
+	if changed == 0 {
+		return
+	}
+	change := Change{Mask: changed, Raw: raw, Version: version}
+
+	checklocksEnterNotify(s)
+	defer checklocksExitNotify(s)
+	s.subMutex.Lock()
+	defer s.subMutex.Unlock()
+	for _, sub := range s.subs {
+		if sub.mask&changed == 0 {
+			continue
+		}
+		select {
+		case sub.ch <- change:
+		default:
+			// Slow consumer: drop the stale pending Change and replace it
+			// with the latest one, so this subscriber cannot build up a
+			// backlog or block the sender. If a newer Change is already
+			// pending -- this notify call lost the race against another
+			// writer's -- keep it instead of overwriting it with our
+			// older one.
+			pending := change
+			select {
+			case p := <-sub.ch:
+				if p.Version > pending.Version {
+					pending = p
+				}
+			default:
+			}
+			select {
+			case sub.ch <- pending:
+			default:
+			}
+		}
+	}
+}
+
+// diffMask computes the ChangeMask between two RawState values.
+func diffMask(old, new RawState) ChangeMask {
+	var mask ChangeMask
+	if old.Code != new.Code {
+		mask |= ChangeCode
+	}
+	if old.Dot != new.Dot {
+		mask |= ChangeDot
+	}
+	if old.Mode != new.Mode {
+		mask |= ChangeMode
+	}
+	if old.Pending != new.Pending {
+		mask |= ChangePending
+	}
+	if !sameNotes(old.Notes, new.Notes) {
+		mask |= ChangeNotes
+	}
+	if old.LastKey != new.LastKey {
+		mask |= ChangeLastKey
+	}
+	return mask
+}
+
+func sameNotes(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
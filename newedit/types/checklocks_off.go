@@ -0,0 +1,15 @@
+//go:build !elvishchecklocks
+
+package types
+
+// Without the elvishchecklocks build tag, the lock-discipline hooks called
+// from state.go and change.go compile away to nothing: the production build pays zero
+// overhead for the diagnostic in checklocks_on.go.
+
+func checklocksEnterView(s *State)         {}
+func checklocksExitView(s *State)          {}
+func checklocksEnterUpdate(s *State)       {}
+func checklocksExitUpdate(s *State)        {}
+func checklocksEnterNotify(s *State)       {}
+func checklocksExitNotify(s *State)        {}
+func checklocksCheckPopForRedraw(s *State) {}
@@ -0,0 +1,146 @@
+//go:build elvishchecklocks
+
+package types
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"sync"
+)
+
+// checklocksState is the lock-discipline bookkeeping for a single goroutine,
+// tracking how it is currently using one or more State values.
+type checklocksState struct {
+	// viewing counts nested View calls; Update may not be entered while
+	// this is non-zero, since a read cannot be upgraded to a write.
+	viewing int
+	// updating is true while an Update callback is running; neither View
+	// nor Update may be entered again until it returns.
+	updating bool
+	// notifying is true while notify is sending to subscriber channels;
+	// PopForRedraw may not be called until it finishes.
+	notifying bool
+}
+
+var (
+	checklocksMu sync.Mutex
+	checklocks   = map[int64]*checklocksState{}
+)
+
+func checklocksStateFor(gid int64) *checklocksState {
+	st := checklocks[gid]
+	if st == nil {
+		st = &checklocksState{}
+		checklocks[gid] = st
+	}
+	return st
+}
+
+// checklocksForget removes gid's entry once it is no longer in any of
+// View, Update or notify, so that a long-running process does not
+// accumulate one entry per goroutine that has ever touched a State --
+// goroutine ids are never reused, so the map would otherwise grow without
+// bound.
+func checklocksForget(gid int64, st *checklocksState) {
+	if st.viewing == 0 && !st.updating && !st.notifying {
+		delete(checklocks, gid)
+	}
+}
+
+func checklocksEnterView(s *State) {
+	gid := checklocksGoroutineID()
+	checklocksMu.Lock()
+	defer checklocksMu.Unlock()
+	st := checklocksStateFor(gid)
+	if st.updating {
+		checklocksViolation("View called while the same goroutine holds an Update window")
+	}
+	st.viewing++
+}
+
+func checklocksExitView(s *State) {
+	gid := checklocksGoroutineID()
+	checklocksMu.Lock()
+	defer checklocksMu.Unlock()
+	if st := checklocks[gid]; st != nil {
+		if st.viewing > 0 {
+			st.viewing--
+		}
+		checklocksForget(gid, st)
+	}
+}
+
+func checklocksEnterUpdate(s *State) {
+	gid := checklocksGoroutineID()
+	checklocksMu.Lock()
+	defer checklocksMu.Unlock()
+	st := checklocksStateFor(gid)
+	if st.updating {
+		checklocksViolation("Update called recursively by the same goroutine")
+	}
+	if st.viewing > 0 {
+		checklocksViolation("Update called while the same goroutine holds a View window")
+	}
+	st.updating = true
+}
+
+func checklocksExitUpdate(s *State) {
+	gid := checklocksGoroutineID()
+	checklocksMu.Lock()
+	defer checklocksMu.Unlock()
+	if st := checklocks[gid]; st != nil {
+		st.updating = false
+		checklocksForget(gid, st)
+	}
+}
+
+func checklocksEnterNotify(s *State) {
+	gid := checklocksGoroutineID()
+	checklocksMu.Lock()
+	defer checklocksMu.Unlock()
+	checklocksStateFor(gid).notifying = true
+}
+
+func checklocksExitNotify(s *State) {
+	gid := checklocksGoroutineID()
+	checklocksMu.Lock()
+	defer checklocksMu.Unlock()
+	if st := checklocks[gid]; st != nil {
+		st.notifying = false
+		checklocksForget(gid, st)
+	}
+}
+
+func checklocksCheckPopForRedraw(s *State) {
+	gid := checklocksGoroutineID()
+	checklocksMu.Lock()
+	defer checklocksMu.Unlock()
+	if st := checklocks[gid]; st != nil && st.notifying {
+		checklocksViolation("PopForRedraw called while a subscriber notification is in progress on the same goroutine")
+	}
+}
+
+// checklocksViolation logs the offending stack and panics. It is called
+// with checklocksMu held, matching how gVisor's checklocks reports lock
+// ordering violations.
+func checklocksViolation(msg string) {
+	fmt.Printf("elvishchecklocks: %s\n%s", msg, debug.Stack())
+	panic("elvishchecklocks: " + msg)
+}
+
+// checklocksGoroutineID extracts the calling goroutine's id by parsing the
+// header line of runtime.Stack, in the absence of a public API for it.
+func checklocksGoroutineID() int64 {
+	var buf [64]byte
+	n := runtime.Stack(buf[:], false)
+	b := bytes.TrimPrefix(buf[:n], []byte("goroutine "))
+	b = b[:bytes.IndexByte(b, ' ')]
+	id, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil {
+		return -1
+	}
+	return id
+}
@@ -1,120 +1,431 @@
 package types
 
 import (
+	"errors"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/elves/elvish/edit/ui"
 )
 
-// State wraps RawState, providing methods for concurrency-safe access. The
-// getter methods also paper over nil values to make the empty State value more
-// usable. Direct field access is also allowed but must be explicitly
-// synchronized.
+// State holds the state of the editor. Reads go through a single atomic
+// load of an immutable *RawState (see Snapshot), so the hot-path getters
+// below never contend with each other or with a concurrent write. Writes
+// are serialized by writeMu, which builds a new RawState from the previous
+// one and publishes it; s.word caches NextAction, a monotonic version
+// counter, and a writer-held bit in a single atomic word, so that code
+// which only needs one of them never needs to dereference the snapshot
+// pointer.
+// LastKey and Mode are not cached in the word: Mode is an open interface
+// type with no guaranteed small representation, and LastKey's Rune can be
+// a negative sentinel for non-printable keys that does not survive being
+// packed into a fixed-width unsigned field, so both are read from the
+// RawState snapshot like Code, Pending and Notes.
+//
+// There is no longer a way to reach the raw fields directly: use View or
+// Update for coherent multi-field access, the individual getters and
+// setters for single fields, or Snapshot for a one-shot read-only copy.
 type State struct {
-	Raw   RawState
-	Mutex sync.RWMutex
+	word atomic.Uint64
+	raw  atomic.Pointer[RawState]
+
+	// writeMu serializes writers; readers never take it.
+	writeMu sync.Mutex
+
+	subMutex sync.Mutex
+	subs     []*subscriber
+
+	undo undoHistory
+}
+
+// word layout, from the low bit up: 16 bits of HandlerAction, 47 bits of
+// monotonic version (wide enough that no realistic editing session will
+// ever wrap it), and a top "writer holds the write lock" bit.
+const (
+	wordNextActionBits = 16
+	wordVersionBits    = 47
+
+	wordNextActionShift = 0
+	wordVersionShift    = wordNextActionShift + wordNextActionBits
+	wordWriterShift     = wordVersionShift + wordVersionBits
+
+	wordNextActionMask = uint64(1)<<wordNextActionBits - 1
+	wordVersionMask    = uint64(1)<<wordVersionBits - 1
+)
+
+func packWord(version uint64, next HandlerAction) uint64 {
+	return (uint64(next)&wordNextActionMask)<<wordNextActionShift |
+		(version&wordVersionMask)<<wordVersionShift
+}
+
+func wordVersion(w uint64) uint64 {
+	return (w >> wordVersionShift) & wordVersionMask
+}
+
+func wordNextAction(w uint64) HandlerAction {
+	return HandlerAction((w >> wordNextActionShift) & wordNextActionMask)
+}
+
+func wordWriterHeld(w uint64) bool {
+	return w&(1<<wordWriterShift) != 0
+}
+
+// loadRaw returns the current snapshot, lazily initializing it so that the
+// zero State value is already usable.
+func (s *State) loadRaw() *RawState {
+	raw := s.raw.Load()
+	if raw == nil {
+		s.raw.CompareAndSwap(nil, &RawState{})
+		raw = s.raw.Load()
+	}
+	return raw
+}
+
+// publish stores raw as the new snapshot and bumps the cached word, leaving
+// the writer-held bit set. Callers must hold writeMu and clear the bit with
+// setWriterHeld(false) before releasing it.
+func (s *State) publish(raw *RawState) {
+	s.raw.Store(raw)
+	word := packWord(wordVersion(s.word.Load())+1, raw.NextAction)
+	s.word.Store(word | 1<<wordWriterShift)
 }
 
-// Returns a copy of the raw state, and set s.Raw.Notes = nil. Used for
-// retrieving the state for rendering.
+// setWriterHeld records in the word whether a writer currently holds
+// writeMu; wordWriterHeld reads it back.
+func (s *State) setWriterHeld(held bool) {
+	for {
+		old := s.word.Load()
+		next := old &^ (1 << wordWriterShift)
+		if held {
+			next |= 1 << wordWriterShift
+		}
+		if s.word.CompareAndSwap(old, next) {
+			return
+		}
+	}
+}
+
+// Snapshot returns the current state as an immutable snapshot. State never
+// mutates a RawState after publishing it, so the result can be read freely
+// without further synchronization.
+func (s *State) Snapshot() *RawState {
+	return s.loadRaw()
+}
+
+// Version returns a counter that is bumped every time a new snapshot is
+// published. Subscribers and renderers that only need to know whether
+// something changed, without caring what, can compare a previously
+// observed Version instead of diffing two RawState values.
+func (s *State) Version() uint64 {
+	return wordVersion(s.word.Load())
+}
+
+// ErrStateClosed is returned, or used as a panic value, when a StateView or
+// StateUpdater is used after the View or Update call that produced it has
+// returned. Handles are only valid for the duration of the callback; holding
+// on to one past that point would let code read or write RawState outside of
+// the critical section that makes it safe.
+var ErrStateClosed = errors.New("state window is closed")
+
+// StateView is a read-only, snapshot-safe handle to a State's RawState,
+// valid only for the duration of the callback passed to State.View.
+type StateView struct {
+	raw    *RawState
+	closed bool
+}
+
+func (v *StateView) checkOpen() {
+	if v.closed {
+		panic(ErrStateClosed)
+	}
+}
+
+func (v *StateView) close() { v.closed = true }
+
+// Mode returns the current mode.
+func (v *StateView) Mode() Mode {
+	v.checkOpen()
+	return v.raw.Mode
+}
+
+// Code returns the code.
+func (v *StateView) Code() string {
+	v.checkOpen()
+	return v.raw.Code
+}
+
+// Dot returns the position of the cursor.
+func (v *StateView) Dot() int {
+	v.checkOpen()
+	return v.raw.Dot
+}
+
+// CodeAndDot returns the code and dot of the state.
+func (v *StateView) CodeAndDot() (string, int) {
+	v.checkOpen()
+	return v.raw.Code, v.raw.Dot
+}
+
+// Pending returns the pending code, if any.
+func (v *StateView) Pending() *PendingCode {
+	v.checkOpen()
+	return v.raw.Pending
+}
+
+// Notes returns the notes added since the last redraw.
+func (v *StateView) Notes() []string {
+	v.checkOpen()
+	return v.raw.Notes
+}
+
+// LastKey returns the last key that was pressed.
+func (v *StateView) LastKey() ui.Key {
+	v.checkOpen()
+	return v.raw.LastKey
+}
+
+// NextAction returns the handler action to return.
+func (v *StateView) NextAction() HandlerAction {
+	v.checkOpen()
+	return v.raw.NextAction
+}
+
+// View calls f with a read-only handle to the current snapshot. Since the
+// snapshot is immutable, View takes no lock at all; it never contends with
+// a concurrent reader or writer. The handle is invalidated when f returns;
+// using it afterwards panics with ErrStateClosed.
+func (s *State) View(f func(v *StateView) error) error {
+	checklocksEnterView(s)
+	defer checklocksExitView(s)
+	v := &StateView{raw: s.loadRaw()}
+	defer v.close()
+	return f(v)
+}
+
+// StateUpdater is a handle that exposes mutators running inside a single
+// critical section, valid only for the duration of the callback passed to
+// State.Update.
+type StateUpdater struct {
+	raw    *RawState
+	closed bool
+}
+
+func (u *StateUpdater) checkOpen() {
+	if u.closed {
+		panic(ErrStateClosed)
+	}
+}
+
+func (u *StateUpdater) close() { u.closed = true }
+
+// SetCodeAndDot sets the code and dot atomically.
+func (u *StateUpdater) SetCodeAndDot(code string, dot int) {
+	u.checkOpen()
+	u.raw.Code = code
+	u.raw.Dot = dot
+}
+
+// SetPending sets the pending code.
+func (u *StateUpdater) SetPending(p *PendingCode) {
+	u.checkOpen()
+	u.raw.Pending = p
+}
+
+// ReplaceRange replaces the part of the code between begin and end (byte
+// indices into the code before the replacement) with text, and adjusts the
+// dot so that it stays anchored to the same logical position: unaffected if
+// it was before begin, shifted by the change in length if it was after end,
+// and moved to the end of text otherwise.
+func (u *StateUpdater) ReplaceRange(begin, end int, text string) {
+	u.checkOpen()
+	code := u.raw.Code
+	dot := u.raw.Dot
+	u.raw.Code = code[:begin] + text + code[end:]
+	switch {
+	case dot < begin:
+		// Unaffected.
+	case dot > end:
+		dot += len(text) - (end - begin)
+	default:
+		dot = begin + len(text)
+	}
+	u.raw.Dot = dot
+}
+
+// AddNote adds a note.
+func (u *StateUpdater) AddNote(note string) {
+	u.checkOpen()
+	u.raw.Notes = append(append([]string(nil), u.raw.Notes...), note)
+}
+
+// SetMode sets the current mode.
+func (u *StateUpdater) SetMode(mode Mode) {
+	u.checkOpen()
+	u.raw.Mode = mode
+}
+
+// SetNextAction sets the handler action to return.
+func (u *StateUpdater) SetNextAction(a HandlerAction) {
+	u.checkOpen()
+	u.raw.NextAction = a
+}
+
+// Update calls f with a handle exposing mutators that all run inside a
+// single critical section serialized by writeMu against other writers. The
+// handle is invalidated when f returns; using it afterwards panics with
+// ErrStateClosed. If f returns a non-nil error, the mutations made through
+// u are discarded: nothing is published, recorded in undo history, or
+// broadcast to subscribers, and Update returns that same error. Otherwise
+// the new snapshot is published and the edit recorded in the undo history
+// while the write lock is still held, and subscribers are notified only
+// after the write lock has been released.
+func (s *State) Update(f func(u *StateUpdater) error) error {
+	checklocksEnterUpdate(s)
+	defer checklocksExitUpdate(s)
+	s.writeMu.Lock()
+	s.setWriterHeld(true)
+	old := s.loadRaw()
+	raw := *old
+	u := &StateUpdater{raw: &raw}
+	err := f(u)
+	u.close()
+	if err != nil {
+		s.setWriterHeld(false)
+		s.writeMu.Unlock()
+		return err
+	}
+	s.publish(&raw)
+	s.undo.record(*old, raw, time.Now())
+	version := s.Version()
+	s.setWriterHeld(false)
+	s.writeMu.Unlock()
+	s.notify(diffMask(*old, raw), raw, version)
+	return nil
+}
+
+// Returns a copy of the raw state, and sets Notes back to nil in the
+// published snapshot. Used for retrieving the state for rendering.
+//
+// This deliberately does not go through Update: a redraw draining its own
+// notes is not an externally interesting change, and routing it through
+// Update would fire a ChangeNotes notification that wakes up any
+// subscriber watching notes, which would then immediately pop them again
+// on its own next redraw -- a feedback loop. So PopForRedraw publishes the
+// cleared snapshot directly, without recording undo history or notifying
+// subscribers.
 func (s *State) PopForRedraw() *RawState {
-	s.Mutex.Lock()
-	defer s.Mutex.Unlock()
-	raw := s.Raw
-	s.Raw.Notes = nil
-	return &raw
+	checklocksCheckPopForRedraw(s)
+	s.writeMu.Lock()
+	s.setWriterHeld(true)
+	old := *s.loadRaw()
+	cleared := old
+	cleared.Notes = nil
+	s.publish(&cleared)
+	s.setWriterHeld(false)
+	s.writeMu.Unlock()
+	return &old
 }
 
 // Returns a finalized State, intended for use in the final redraw.
 func (s *State) Finalize() *RawState {
-	s.Mutex.RLock()
-	defer s.Mutex.RUnlock()
-	return &RawState{
-		dummyMode{}, s.Raw.Code, len(s.Raw.Code), nil, s.Raw.Notes, ui.Key{}, 0}
+	raw := s.loadRaw()
+	return &RawState{dummyMode{}, raw.Code, len(raw.Code), nil, raw.Notes, ui.Key{}, 0}
 }
 
 // Mode returns the current mode.
 func (s *State) Mode() Mode {
-	s.Mutex.RLock()
-	defer s.Mutex.RUnlock()
-	return s.Raw.Mode
+	return s.loadRaw().Mode
 }
 
 // SetMode sets the current mode.
 func (s *State) SetMode(mode Mode) {
-	s.Mutex.Lock()
-	defer s.Mutex.Unlock()
-	s.Raw.Mode = mode
+	s.mutate(func(raw *RawState) { raw.Mode = mode })
 }
 
 // Code returns the code.
 func (s *State) Code() string {
-	s.Mutex.RLock()
-	defer s.Mutex.RUnlock()
-	return s.Raw.Code
+	return s.loadRaw().Code
 }
 
 // CodeAndDot returns the code and dot of the state.
 func (s *State) CodeAndDot() (string, int) {
-	s.Mutex.RLock()
-	defer s.Mutex.RUnlock()
-	return s.Raw.Code, s.Raw.Dot
+	raw := s.loadRaw()
+	return raw.Code, raw.Dot
 }
 
 // CodeBeforeDot returns the part of code before the dot.
 func (s *State) CodeBeforeDot() string {
-	s.Mutex.RLock()
-	defer s.Mutex.RUnlock()
-	return s.Raw.Code[:s.Raw.Dot]
+	raw := s.loadRaw()
+	return raw.Code[:raw.Dot]
 }
 
 // CodeAfterDot returns the part of code after the dot.
 func (s *State) CodeAfterDot() string {
-	s.Mutex.RLock()
-	defer s.Mutex.RUnlock()
-	return s.Raw.Code[s.Raw.Dot:]
+	raw := s.loadRaw()
+	return raw.Code[raw.Dot:]
 }
 
 // AddNote adds a note.
 func (s *State) AddNote(note string) {
-	s.Mutex.Lock()
-	defer s.Mutex.Unlock()
-	s.Raw.Notes = append(s.Raw.Notes, note)
+	s.mutate(func(raw *RawState) {
+		raw.Notes = append(append([]string(nil), raw.Notes...), note)
+	})
 }
 
 // LastKey returns LastKey from the raw state.
 func (s *State) LastKey() ui.Key {
-	s.Mutex.RLock()
-	defer s.Mutex.RUnlock()
-	return s.Raw.LastKey
+	return s.loadRaw().LastKey
 }
 
 // SetLastKey sets LastKey of the raw state.
 func (s *State) SetLastKey(k ui.Key) {
-	s.Mutex.Lock()
-	defer s.Mutex.Unlock()
-	s.Raw.LastKey = k
+	s.mutate(func(raw *RawState) { raw.LastKey = k })
 }
 
-// NextAction returns NextAction from the raw state.
+// NextAction returns NextAction from the raw state. It is read directly
+// from the packed word, so it costs a single atomic load with no pointer
+// chase.
 func (s *State) NextAction() HandlerAction {
-	s.Mutex.RLock()
-	defer s.Mutex.RUnlock()
-	return s.Raw.NextAction
+	return wordNextAction(s.word.Load())
 }
 
 // SetNextAction sets NextAction of the raw state.
 func (s *State) SetNextAction(a HandlerAction) {
-	s.Mutex.Lock()
-	defer s.Mutex.Unlock()
-	s.Raw.NextAction = a
+	s.mutate(func(raw *RawState) { raw.NextAction = a })
 }
 
-// Reset resets the internal state to an empty value.
+// Reset resets the internal state to an empty value, discarding undo
+// history along with it.
 func (s *State) Reset() {
-	s.Mutex.Lock()
-	defer s.Mutex.Unlock()
-	s.Raw = RawState{}
+	s.writeMu.Lock()
+	s.setWriterHeld(true)
+	old := s.loadRaw()
+	raw := RawState{}
+	s.publish(&raw)
+	s.undo.reset()
+	version := s.Version()
+	s.setWriterHeld(false)
+	s.writeMu.Unlock()
+	s.notify(diffMask(*old, raw), raw, version)
+}
+
+// mutate builds a new snapshot by applying fn to a copy of the current one,
+// publishes it under writeMu, records the resulting edit in the undo
+// history, and notifies subscribers of the diff after the lock has been
+// released.
+func (s *State) mutate(fn func(raw *RawState)) {
+	s.writeMu.Lock()
+	s.setWriterHeld(true)
+	old := s.loadRaw()
+	raw := *old
+	fn(&raw)
+	s.publish(&raw)
+	s.undo.record(*old, raw, time.Now())
+	version := s.Version()
+	s.setWriterHeld(false)
+	s.writeMu.Unlock()
+	s.notify(diffMask(*old, raw), raw, version)
 }
 
 // RawState contains all the state of the editor.
@@ -0,0 +1,259 @@
+package types
+
+import (
+	"testing"
+	"time"
+
+	"github.com/elves/elvish/edit/ui"
+)
+
+func setCodeAndDot(t *testing.T, s *State, code string, dot int) {
+	t.Helper()
+	err := s.Update(func(u *StateUpdater) error {
+		u.SetCodeAndDot(code, dot)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Update returned error: %v", err)
+	}
+}
+
+func TestReplaceRangeDotAnchoring(t *testing.T) {
+	tests := []struct {
+		name       string
+		code       string
+		dot        int
+		begin, end int
+		text       string
+		wantCode   string
+		wantDot    int
+	}{
+		{
+			name: "dot before begin is unaffected",
+			code: "foo bar", dot: 1,
+			begin: 4, end: 7, text: "baz",
+			wantCode: "foo baz", wantDot: 1,
+		},
+		{
+			name: "dot after end shifts by the length delta",
+			code: "foo bar", dot: 7,
+			begin: 0, end: 3, text: "quux",
+			wantCode: "quux bar", wantDot: 8,
+		},
+		{
+			name: "dot inside the range moves to the end of the replacement",
+			code: "foo bar", dot: 5,
+			begin: 4, end: 7, text: "baz",
+			wantCode: "foo baz", wantDot: 7,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s State
+			setCodeAndDot(t, &s, tt.code, tt.dot)
+			err := s.Update(func(u *StateUpdater) error {
+				u.ReplaceRange(tt.begin, tt.end, tt.text)
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("Update returned error: %v", err)
+			}
+			code, dot := s.CodeAndDot()
+			if code != tt.wantCode || dot != tt.wantDot {
+				t.Errorf("got (%q, %d), want (%q, %d)", code, dot, tt.wantCode, tt.wantDot)
+			}
+		})
+	}
+}
+
+func TestUndoCoalescesWithinWindow(t *testing.T) {
+	var s State
+	s.ConfigureUndo(UndoConfig{MaxDepth: 10, CoalesceWindow: 50 * time.Millisecond})
+
+	setCodeAndDot(t, &s, "a", 1)
+	setCodeAndDot(t, &s, "ab", 2)
+	setCodeAndDot(t, &s, "abc", 3)
+
+	if code, _ := s.CodeAndDot(); code != "abc" {
+		t.Fatalf("CodeAndDot() = %q, want %q", code, "abc")
+	}
+
+	if !s.Undo() {
+		t.Fatal("Undo() = false, want true")
+	}
+	if code, _ := s.CodeAndDot(); code != "" {
+		t.Errorf("after undoing the coalesced group, CodeAndDot() = %q, want empty", code)
+	}
+	if s.Undo() {
+		t.Error("Undo() = true with no more groups, want false")
+	}
+}
+
+func TestUndoDoesNotCoalesceNonContiguousInserts(t *testing.T) {
+	var s State
+	s.ConfigureUndo(UndoConfig{MaxDepth: 10, CoalesceWindow: time.Second})
+
+	// Both inserts are single runes within the coalescing window, but the
+	// second lands at the front of the code rather than right after the
+	// first, so they must not be merged into one undo group.
+	setCodeAndDot(t, &s, "a", 1)
+	setCodeAndDot(t, &s, "xa", 1)
+
+	if !s.Undo() {
+		t.Fatal("Undo() = false, want true")
+	}
+	if code, _ := s.CodeAndDot(); code != "a" {
+		t.Errorf("after one Undo, CodeAndDot() = %q, want %q", code, "a")
+	}
+	if !s.Undo() {
+		t.Fatal("second Undo() = false, want true")
+	}
+	if code, _ := s.CodeAndDot(); code != "" {
+		t.Errorf("after two Undos, CodeAndDot() = %q, want empty", code)
+	}
+}
+
+func TestUndoDoesNotCoalesceAcrossWindow(t *testing.T) {
+	var s State
+	s.ConfigureUndo(UndoConfig{MaxDepth: 10, CoalesceWindow: 10 * time.Millisecond})
+
+	setCodeAndDot(t, &s, "a", 1)
+	time.Sleep(30 * time.Millisecond)
+	setCodeAndDot(t, &s, "ab", 2)
+
+	if !s.Undo() {
+		t.Fatal("Undo() = false, want true")
+	}
+	if code, _ := s.CodeAndDot(); code != "a" {
+		t.Errorf("after one Undo, CodeAndDot() = %q, want %q", code, "a")
+	}
+	if !s.Undo() {
+		t.Fatal("second Undo() = false, want true")
+	}
+	if code, _ := s.CodeAndDot(); code != "" {
+		t.Errorf("after two Undos, CodeAndDot() = %q, want empty", code)
+	}
+}
+
+func TestCheckpointForcesNewGroup(t *testing.T) {
+	var s State
+	s.ConfigureUndo(UndoConfig{MaxDepth: 10, CoalesceWindow: time.Second})
+
+	setCodeAndDot(t, &s, "a", 1)
+	s.Checkpoint()
+	setCodeAndDot(t, &s, "ab", 2)
+
+	if !s.Undo() {
+		t.Fatal("Undo() = false, want true")
+	}
+	if code, _ := s.CodeAndDot(); code != "a" {
+		t.Errorf("after one Undo past a checkpoint, CodeAndDot() = %q, want %q", code, "a")
+	}
+}
+
+func TestUndoRedoRoundTrip(t *testing.T) {
+	var s State
+	s.ConfigureUndo(UndoConfig{MaxDepth: 10, CoalesceWindow: time.Second})
+
+	setCodeAndDot(t, &s, "a", 1)
+	s.Checkpoint()
+	setCodeAndDot(t, &s, "ab", 2)
+
+	s.Undo()
+	if !s.Redo() {
+		t.Fatal("Redo() = false, want true")
+	}
+	if code, _ := s.CodeAndDot(); code != "ab" {
+		t.Errorf("after Undo then Redo, CodeAndDot() = %q, want %q", code, "ab")
+	}
+	if s.Redo() {
+		t.Error("Redo() = true with no more groups, want false")
+	}
+}
+
+func TestSubscribeDropsStaleChangeForSlowSubscriber(t *testing.T) {
+	var s State
+	ch, cancel := s.Subscribe(ChangeCode)
+	defer cancel()
+
+	// The subscriber never reads the first Change; notify must replace it
+	// with the second rather than queue up behind it or block the sender.
+	setCodeAndDot(t, &s, "a", 1)
+	done := make(chan struct{})
+	go func() {
+		s.Update(func(u *StateUpdater) error {
+			u.SetCodeAndDot("ab", 2)
+			return nil
+		})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("SetCodeAndDot blocked on a slow subscriber instead of dropping the stale Change")
+	}
+
+	select {
+	case change := <-ch:
+		if change.Mask&ChangeCode == 0 {
+			t.Errorf("Change.Mask = %v, want ChangeCode set", change.Mask)
+		}
+		if change.Raw.Code != "ab" {
+			t.Errorf("got stale Change with Code = %q, want the latest %q", change.Raw.Code, "ab")
+		}
+	default:
+		t.Fatal("expected a coalesced Change to be available, got none")
+	}
+
+	select {
+	case change := <-ch:
+		t.Errorf("got unexpected extra Change %+v, want channel to only ever hold one pending Change", change)
+	default:
+	}
+}
+
+func TestSubscribeCancel(t *testing.T) {
+	var s State
+	ch, cancel := s.Subscribe(ChangeCode)
+	cancel()
+	cancel() // must be idempotent
+
+	setCodeAndDot(t, &s, "a", 1)
+	if _, ok := <-ch; ok {
+		t.Error("channel should be closed after cancel")
+	}
+}
+
+func TestLastKeyRoundTripsNegativeRune(t *testing.T) {
+	var s State
+	// Elvish represents non-printable keys (arrows, function keys, etc.)
+	// with a negative sentinel rune; LastKey must return it unchanged,
+	// not truncated or reinterpreted as a large positive value.
+	k := ui.Key{Rune: -1, Mod: 0}
+	s.SetLastKey(k)
+	if got := s.LastKey(); got != k {
+		t.Errorf("LastKey() = %+v, want %+v", got, k)
+	}
+}
+
+func TestPopForRedrawDoesNotNotifySubscribers(t *testing.T) {
+	var s State
+	s.AddNote("hello")
+
+	ch, cancel := s.Subscribe(ChangeNotes)
+	defer cancel()
+
+	raw := s.PopForRedraw()
+	if len(raw.Notes) != 1 || raw.Notes[0] != "hello" {
+		t.Errorf("PopForRedraw() returned Notes = %v, want [hello]", raw.Notes)
+	}
+	if notes := s.Snapshot().Notes; notes != nil {
+		t.Errorf("Notes after PopForRedraw = %v, want nil", notes)
+	}
+
+	select {
+	case change := <-ch:
+		t.Errorf("PopForRedraw notified subscribers with %+v, want no notification", change)
+	default:
+	}
+}
@@ -0,0 +1,251 @@
+package types
+
+import (
+	"time"
+	"unicode/utf8"
+)
+
+// UndoConfig configures the undo/redo ring attached to a State.
+type UndoConfig struct {
+	// MaxDepth is the maximum number of undo groups retained; 0 means no
+	// limit. Older groups are discarded once it is exceeded.
+	MaxDepth int
+	// CoalesceWindow is the maximum gap between two contiguous
+	// single-rune insertions for them to be merged into the same undo
+	// group, the way most editors treat ordinary typing as one undo step.
+	CoalesceWindow time.Duration
+}
+
+// DefaultUndoConfig is the UndoConfig used until ConfigureUndo is called.
+var DefaultUndoConfig = UndoConfig{MaxDepth: 200, CoalesceWindow: 500 * time.Millisecond}
+
+// codeDelta records one reversible edit to Code, Dot and Mode. Begin and
+// oldText/newText describe a byte range of Code rather than a full copy of
+// the buffer, so recording a delta stays cheap even for large buffers.
+type codeDelta struct {
+	begin            int
+	oldText, newText string
+	oldDot, newDot   int
+	oldMode, newMode Mode
+}
+
+func (d codeDelta) isNoop() bool {
+	return d.oldText == d.newText && d.oldDot == d.newDot && d.oldMode == d.newMode
+}
+
+// undoGroup is a sequence of deltas undone or redone as one step.
+type undoGroup struct {
+	deltas []codeDelta
+}
+
+// undoHistory is the undo/redo ring embedded in a State. It is only ever
+// touched while the owning State's write lock is held.
+type undoHistory struct {
+	cfg        UndoConfig
+	configured bool
+
+	undo []undoGroup
+	redo []undoGroup
+
+	// openGroup indexes the undo group that a new single-rune insertion
+	// may still be coalesced into; -1 if the last group is closed.
+	openGroup int
+	lastEdit  time.Time
+	// nextInsertOffset is the begin offset the next delta must land at to
+	// be coalesced into openGroup: the end of the previous insertion. This
+	// keeps coalescing limited to contiguous typing, rather than also
+	// merging unrelated single-rune edits that happen to fall within the
+	// coalescing window.
+	nextInsertOffset int
+}
+
+func (h *undoHistory) configOrDefault() UndoConfig {
+	if h.configured {
+		return h.cfg
+	}
+	return DefaultUndoConfig
+}
+
+func (h *undoHistory) configure(cfg UndoConfig) {
+	h.cfg = cfg
+	h.configured = true
+}
+
+func (h *undoHistory) reset() {
+	h.undo = nil
+	h.redo = nil
+	h.openGroup = -1
+	h.nextInsertOffset = 0
+}
+
+// checkpoint forces the next recorded delta to start a new undo group,
+// instead of possibly coalescing into the last one.
+func (h *undoHistory) checkpoint() {
+	h.openGroup = -1
+}
+
+// record captures the edit between old and new as a delta, coalescing it
+// into the currently open group when it is a single-rune insertion recorded
+// within the configured coalescing window, contiguous with the end of the
+// previous insertion in that group.
+func (h *undoHistory) record(old, new RawState, now time.Time) {
+	begin, oldEnd, newEnd := diffRange(old.Code, new.Code)
+	d := codeDelta{
+		begin:   begin,
+		oldText: old.Code[begin:oldEnd],
+		newText: new.Code[begin:newEnd],
+		oldDot:  old.Dot, newDot: new.Dot,
+		oldMode: old.Mode, newMode: new.Mode,
+	}
+	if d.isNoop() {
+		return
+	}
+
+	h.redo = nil
+	cfg := h.configOrDefault()
+	if h.openGroup >= 0 && h.openGroup < len(h.undo) &&
+		now.Sub(h.lastEdit) <= cfg.CoalesceWindow && isSingleRuneInsert(d) &&
+		d.begin == h.nextInsertOffset {
+		g := &h.undo[h.openGroup]
+		g.deltas = append(g.deltas, d)
+	} else {
+		h.undo = append(h.undo, undoGroup{deltas: []codeDelta{d}})
+		h.openGroup = len(h.undo) - 1
+		if cfg.MaxDepth > 0 && len(h.undo) > cfg.MaxDepth {
+			h.undo = h.undo[len(h.undo)-cfg.MaxDepth:]
+			h.openGroup = len(h.undo) - 1
+		}
+	}
+	h.lastEdit = now
+	h.nextInsertOffset = d.begin + len(d.newText)
+}
+
+func isSingleRuneInsert(d codeDelta) bool {
+	return d.oldText == "" && utf8.RuneCountInString(d.newText) == 1
+}
+
+// undoOne pops the most recent undo group, if any, applies its deltas in
+// reverse to raw and pushes it onto the redo stack. It reports whether
+// there was a group to undo.
+func (h *undoHistory) undoOne(raw *RawState) bool {
+	if len(h.undo) == 0 {
+		return false
+	}
+	g := h.undo[len(h.undo)-1]
+	h.undo = h.undo[:len(h.undo)-1]
+	h.openGroup = -1
+	for i := len(g.deltas) - 1; i >= 0; i-- {
+		g.deltas[i].unapply(raw)
+	}
+	h.redo = append(h.redo, g)
+	return true
+}
+
+// redoOne pops the most recent redo group, if any, replays its deltas onto
+// raw and pushes it back onto the undo stack. It reports whether there was
+// a group to redo.
+func (h *undoHistory) redoOne(raw *RawState) bool {
+	if len(h.redo) == 0 {
+		return false
+	}
+	g := h.redo[len(h.redo)-1]
+	h.redo = h.redo[:len(h.redo)-1]
+	for _, d := range g.deltas {
+		d.apply(raw)
+	}
+	h.undo = append(h.undo, g)
+	h.openGroup = -1
+	return true
+}
+
+func (d codeDelta) apply(raw *RawState) {
+	raw.Code = raw.Code[:d.begin] + d.newText + raw.Code[d.begin+len(d.oldText):]
+	raw.Dot = d.newDot
+	raw.Mode = d.newMode
+}
+
+func (d codeDelta) unapply(raw *RawState) {
+	raw.Code = raw.Code[:d.begin] + d.oldText + raw.Code[d.begin+len(d.newText):]
+	raw.Dot = d.oldDot
+	raw.Mode = d.oldMode
+}
+
+// diffRange returns the smallest byte range [begin, oldEnd) of oldCode and
+// [begin, newEnd) of newCode that differ, by trimming their common prefix
+// and suffix.
+func diffRange(oldCode, newCode string) (begin, oldEnd, newEnd int) {
+	n := len(oldCode)
+	if len(newCode) < n {
+		n = len(newCode)
+	}
+	for begin < n && oldCode[begin] == newCode[begin] {
+		begin++
+	}
+	oldEnd, newEnd = len(oldCode), len(newCode)
+	for oldEnd > begin && newEnd > begin && oldCode[oldEnd-1] == newCode[newEnd-1] {
+		oldEnd--
+		newEnd--
+	}
+	return begin, oldEnd, newEnd
+}
+
+// ConfigureUndo sets the depth and coalescing window of s's undo/redo ring.
+// It must be called before any edits are made to take full effect, but may
+// be called at any time.
+func (s *State) ConfigureUndo(cfg UndoConfig) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.undo.configure(cfg)
+}
+
+// Checkpoint forces a boundary in the undo history, so that the next edit
+// starts a new undo group instead of coalescing into the previous one. Call
+// it around discrete events like completion accept, paste, or a mode
+// transition.
+func (s *State) Checkpoint() {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.undo.checkpoint()
+}
+
+// Undo reverts the most recent undo group, if any, and reports whether it
+// did so.
+func (s *State) Undo() bool {
+	s.writeMu.Lock()
+	s.setWriterHeld(true)
+	old := *s.loadRaw()
+	raw := old
+	ok := s.undo.undoOne(&raw)
+	var version uint64
+	if ok {
+		s.publish(&raw)
+		version = s.Version()
+	}
+	s.setWriterHeld(false)
+	s.writeMu.Unlock()
+	if ok {
+		s.notify(diffMask(old, raw), raw, version)
+	}
+	return ok
+}
+
+// Redo replays the most recently undone group, if any, and reports whether
+// it did so.
+func (s *State) Redo() bool {
+	s.writeMu.Lock()
+	s.setWriterHeld(true)
+	old := *s.loadRaw()
+	raw := old
+	ok := s.undo.redoOne(&raw)
+	var version uint64
+	if ok {
+		s.publish(&raw)
+		version = s.Version()
+	}
+	s.setWriterHeld(false)
+	s.writeMu.Unlock()
+	if ok {
+		s.notify(diffMask(old, raw), raw, version)
+	}
+	return ok
+}